@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseSubject parses a comma-separated list of RDNs, e.g.
+// "CN=example.com,O=Example Inc,C=US", into a pkix.Name. It supports the
+// handful of attributes that ceremony tooling typically needs; anything
+// more exotic should be built with a real CSR.
+func parseSubject(subject string) (pkix.Name, error) {
+	var name pkix.Name
+	for _, part := range strings.Split(subject, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return pkix.Name{}, fmt.Errorf("malformed RDN %q in --csr-subject", part)
+		}
+		key, value := strings.ToUpper(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "CN":
+			name.CommonName = value
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "C":
+			name.Country = append(name.Country, value)
+		default:
+			return pkix.Name{}, fmt.Errorf("unsupported RDN attribute %q in --csr-subject", key)
+		}
+	}
+	if name.CommonName == "" {
+		return pkix.Name{}, fmt.Errorf("--csr-subject must include a CN")
+	}
+	return name, nil
+}
+
+// emitCSR signs a PKCS#10 CSR with the given subject using signer, and
+// writes it as PEM to stdout.
+func emitCSR(signer *pkcs11Signer, subject pkix.Name) error {
+	tmpl := &x509.CertificateRequest{
+		Subject:            subject,
+		SignatureAlgorithm: csrSignatureAlgorithm(signer),
+	}
+	csrDER, err := x509.CreateCertificateRequest(nil, tmpl, signer)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %s", err)
+	}
+	return pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+}
+
+// emitSelfSignedCert builds and signs a self-signed certificate with the
+// given subject using signer, and writes it as PEM to stdout. It is
+// intended for producing test certificates, not for issuing roots.
+func emitSelfSignedCert(signer *pkcs11Signer, subject pkix.Name) error {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               subject,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SignatureAlgorithm:    csrSignatureAlgorithm(signer),
+	}
+	certDER, err := x509.CreateCertificate(nil, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		return fmt.Errorf("failed to create self-signed certificate: %s", err)
+	}
+	return pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+}
+
+// curveSignatureAlgorithm maps an ECDSA curve to the ECDSA signature
+// algorithm whose hash is conventionally paired with it (P-256/SHA-256,
+// P-384/SHA-384, P-521/SHA-512), so that stronger curves aren't signed with
+// an undersized digest.
+var curveSignatureAlgorithm = map[elliptic.Curve]x509.SignatureAlgorithm{
+	elliptic.P224(): x509.ECDSAWithSHA256,
+	elliptic.P256(): x509.ECDSAWithSHA256,
+	elliptic.P384(): x509.ECDSAWithSHA384,
+	elliptic.P521(): x509.ECDSAWithSHA512,
+}
+
+// csrSignatureAlgorithm picks the x509.SignatureAlgorithm matching the key
+// type backing signer: SHA-256 for RSA, pure Ed25519 for Ed25519, and for
+// ECDSA the hash conventionally paired with the key's curve.
+func csrSignatureAlgorithm(signer *pkcs11Signer) x509.SignatureAlgorithm {
+	switch pub := signer.pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	case *ecdsa.PublicKey:
+		if alg, present := curveSignatureAlgorithm[pub.Curve]; present {
+			return alg
+		}
+		return x509.ECDSAWithSHA256
+	default:
+		return x509.ECDSAWithSHA256
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// oidEd25519 is the id-Ed25519 OID (1.3.101.112) that CKA_EC_PARAMS must be
+// set to when generating a CKM_EC_EDWARDS_KEY_PAIR_GEN key pair.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// ckmECEdwardsKeyPairGen is CKM_EC_EDWARDS_KEY_PAIR_GEN, a PKCS#11 3.0
+// mechanism that github.com/miekg/pkcs11 has not picked up yet. The value
+// comes straight from the OASIS PKCS#11 3.0 mechanism list.
+const ckmECEdwardsKeyPairGen = 0x00001055
+
+func edArgs(label string) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	encodedCurve, err := asn1.Marshal(oidEd25519)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return []*pkcs11.Mechanism{
+			pkcs11.NewMechanism(ckmECEdwardsKeyPairGen, nil),
+		}, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, encodedCurve),
+		}, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		}, nil
+}
+
+func edPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle) (ed25519.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attrs {
+		if a.Type != pkcs11.CKA_EC_POINT {
+			continue
+		}
+		point := a.Value
+		// As with CKA_EC_POINT for ECDSA keys, some PKCS#11 v2.20 modules
+		// wrap the raw point in a DER OCTET STRING.
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(point, &raw); err == nil && len(raw.Bytes) == ed25519.PublicKeySize {
+			point = raw.Bytes
+		}
+		if len(point) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid CKA_EC_POINT value")
+		}
+		return ed25519.PublicKey(point), nil
+	}
+	return nil, errors.New("couldn't retrieve EC point")
+}
+
+// GenerateEdKey creates an Ed25519 key pair in the given session and returns
+// the corresponding public key along with the handles of the newly created
+// public and private key objects.
+func GenerateEdKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (ed25519.PublicKey, pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m, pubTmpl, privTmpl, err := edArgs(label)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	pub, priv, err := ctx.GenerateKeyPair(session, m, pubTmpl, privTmpl)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to generate Ed25519 key pair: %s", err)
+	}
+	pubKey, err := edPub(ctx, session, pub)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return pubKey, pub, priv, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/miekg/pkcs11"
+)
+
+// parsePEMPrivateKey reads a PEM-encoded RSA or ECDSA private key from path,
+// trying PKCS#1, SEC1, and PKCS#8 in turn.
+func parsePEMPrivateKey(path string) (interface{}, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %s", path, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %q", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key in %q: %s", path, err)
+	}
+	return key, nil
+}
+
+// ImportKey reads the RSA or ECDSA private key PEM at path and creates the
+// corresponding CKO_PRIVATE_KEY / CKO_PUBLIC_KEY objects on the HSM via
+// CreateObject, exposing the plaintext key material to the module the same
+// way GenerateRSAKey/GenerateECKey expose freshly generated material. It
+// returns the public key along with the handles of the newly created public
+// and private key objects.
+func ImportKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label, path string) (interface{}, pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	key, err := parsePEMPrivateKey(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pub, priv, err := importRSAKey(ctx, session, label, k)
+		return &k.PublicKey, pub, priv, err
+	case *ecdsa.PrivateKey:
+		pub, priv, err := importECKey(ctx, session, label, k)
+		return &k.PublicKey, pub, priv, err
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+func importRSAKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, key *rsa.PrivateKey) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	key.Precompute()
+	pubTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+	}
+	privTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+	}
+	pub, err := ctx.CreateObject(session, pubTmpl)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create RSA public key object: %s", err)
+	}
+	priv, err := ctx.CreateObject(session, privTmpl)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create RSA private key object: %s", err)
+	}
+	return pub, priv, nil
+}
+
+func importECKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, key *ecdsa.PrivateKey) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	encodedCurve, err := asn1.Marshal(curveToOID[key.Curve])
+	if err != nil {
+		return 0, 0, err
+	}
+	point := elliptic.Marshal(key.Curve, key.X, key.Y)
+	encodedPoint, err := asn1.Marshal(point)
+	if err != nil {
+		return 0, 0, err
+	}
+	pubTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, encodedCurve),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, encodedPoint),
+	}
+	privTmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, encodedCurve),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, key.D.Bytes()),
+	}
+	pub, err := ctx.CreateObject(session, pubTmpl)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create EC public key object: %s", err)
+	}
+	priv, err := ctx.CreateObject(session, privTmpl)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create EC private key object: %s", err)
+	}
+	return pub, priv, nil
+}
+
+// findObjectByLabel looks up a single object of the given class with the
+// given CKA_LABEL, as used to locate an existing wrapping key by its label.
+func findObjectByLabel(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, class uint) (pkcs11.ObjectHandle, error) {
+	err := ctx.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to initialize object search: %s", err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to search for object: %s", err)
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("no object found with label %q", label)
+	}
+	return objs[0], nil
+}
+
+// UnwrapKey unwraps the wrapped key blob at path onto the HSM using the
+// wrapping key object labeled wrapLabel, so that the plaintext key material
+// is only ever reconstructed inside the module, and returns the handle of
+// the resulting private key object. keyType is the CKK_* type of the key
+// being unwrapped (e.g. pkcs11.CKK_RSA), which together with CKA_CLASS must
+// be set on the unwrap template since neither CKM_RSA_PKCS_OAEP nor
+// CKM_AES_KEY_WRAP_PAD implies it.
+func UnwrapKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label, path, wrapLabel string, mechanism, keyType uint) (pkcs11.ObjectHandle, error) {
+	wrappedKey, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read wrapped key %q: %s", path, err)
+	}
+
+	var mech *pkcs11.Mechanism
+	var wrapKeyClass uint
+	switch mechanism {
+	case pkcs11.CKM_RSA_PKCS_OAEP:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, nil)
+		wrapKeyClass = pkcs11.CKO_PRIVATE_KEY
+	case pkcs11.CKM_AES_KEY_WRAP_PAD:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)
+		wrapKeyClass = pkcs11.CKO_SECRET_KEY
+	default:
+		return 0, fmt.Errorf("unsupported wrap mechanism %d", mechanism)
+	}
+
+	wrappingKey, err := findObjectByLabel(ctx, session, wrapLabel, wrapKeyClass)
+	if err != nil {
+		return 0, err
+	}
+
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	}
+	priv, err := ctx.UnwrapKey(session, []*pkcs11.Mechanism{mech}, wrappingKey, wrappedKey, tmpl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unwrap key: %s", err)
+	}
+	return priv, nil
+}
@@ -7,7 +7,9 @@ import (
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"flag"
+	"fmt"
 	"math/big"
 	"os"
 
@@ -33,13 +35,13 @@ func rsaArgs(label string, mod int) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, [
 		}
 }
 
-func rsaPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle) *rsa.PublicKey {
+func rsaPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
 	attrs, err := ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
 	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	pubKey := &rsa.PublicKey{}
@@ -55,9 +57,9 @@ func rsaPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectH
 		}
 	}
 	if !gotExp || !gotMod {
-		panic("Couldn't retrieve modulus or exponent")
+		return nil, errors.New("couldn't retrieve modulus or exponent")
 	}
-	return pubKey
+	return pubKey, nil
 }
 
 var stringToCurve = map[string]elliptic.Curve{
@@ -74,10 +76,10 @@ var curveToOID = map[elliptic.Curve]asn1.ObjectIdentifier{
 	elliptic.P521(): asn1.ObjectIdentifier{1, 3, 132, 0, 35},
 }
 
-func ecArgs(label string, curve elliptic.Curve) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute) {
+func ecArgs(label string, curve elliptic.Curve) ([]*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
 	encodedCurve, err := asn1.Marshal(curveToOID[curve])
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
 	return []*pkcs11.Mechanism{
 			pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil),
@@ -92,17 +94,17 @@ func ecArgs(label string, curve elliptic.Curve) ([]*pkcs11.Mechanism, []*pkcs11.
 			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
 			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
 			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
-		}
+		}, nil
 }
 
-func ecPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle, curve elliptic.Curve) *ecdsa.PublicKey {
+func ecPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
 	attrs, err := ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
 	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	pubKey := &ecdsa.PublicKey{Curve: curve}
@@ -118,10 +120,10 @@ func ecPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHa
 				var point asn1.RawValue
 				_, err = asn1.Unmarshal(a.Value, &point)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
 				if len(point.Bytes) == 0 {
-					panic("Invalid CKA_EC_POINT value")
+					return nil, errors.New("invalid CKA_EC_POINT value")
 				}
 				x, y = elliptic.Unmarshal(curve, point.Bytes)
 			}
@@ -131,91 +133,257 @@ func ecPub(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHa
 		}
 	}
 	if !gotPoint {
-		panic("Couldn't retrieve EC point")
+		return nil, errors.New("couldn't retrieve EC point")
 	}
-	return pubKey
+	return pubKey, nil
 }
 
-func main() {
+// GenerateRSAKey creates an RSA key pair of the given modulus size in the
+// given session and returns the corresponding public key along with the
+// handles of the newly created public and private key objects.
+func GenerateRSAKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, modLen int) (*rsa.PublicKey, pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m, pubTmpl, privTmpl := rsaArgs(label, modLen)
+	pub, priv, err := ctx.GenerateKeyPair(session, m, pubTmpl, privTmpl)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to generate RSA key pair: %s", err)
+	}
+	pubKey, err := rsaPub(ctx, session, pub)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return pubKey, pub, priv, nil
+}
+
+// GenerateECKey creates an ECDSA key pair on the given curve in the given
+// session and returns the corresponding public key along with the handles
+// of the newly created public and private key objects.
+func GenerateECKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, curve elliptic.Curve) (*ecdsa.PublicKey, pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m, pubTmpl, privTmpl, err := ecArgs(label, curve)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	pub, priv, err := ctx.GenerateKeyPair(session, m, pubTmpl, privTmpl)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to generate EC key pair: %s", err)
+	}
+	pubKey, err := ecPub(ctx, session, pub, curve)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return pubKey, pub, priv, nil
+}
+
+// findSlotByTokenLabel walks the list of slots with a token present looking
+// for one whose token label matches tokenLabel, returning its slot ID. This
+// lets callers avoid hardcoding slot IDs, which differ between HSMs and can
+// shift when tokens are re-initialized.
+func findSlotByTokenLabel(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list slots: %s", err)
+	}
+	for _, slot := range slots {
+		ti, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get token info for slot %d: %s", slot, err)
+		}
+		if ti.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no slot found with token label %q", tokenLabel)
+}
+
+func run() error {
 	module := flag.String("module", "", "PKCS#11 module to use")
-	keyType := flag.String("type", "", "Type of key to generate (RSA or ECDSA)")
+	keyType := flag.String("type", "", "Type of key to generate (RSA, ECDSA, or Ed25519)")
 	slot := flag.Uint("slot", 0, "Slot to generate key in")
+	tokenLabel := flag.String("token-label", "", "Label of the token to generate the key in, used instead of --slot")
 	pin := flag.String("pin", "", "PIN for slot")
 	label := flag.String("label", "", "Key label")
 	rsaModLen := flag.Int("modulus-bits", 0, "Size of RSA modulus in bits. Only valid if --type=RSA")
 	ecdsaCurve := flag.String("curve", "", "Type of ECDSA curve to use (). Only valid if --type=ECDSA")
+	csrSubject := flag.String("csr-subject", "", "If set, emit a PKCS#10 CSR with this subject (e.g. \"CN=example.com\"), signed by the generated key")
+	selfSign := flag.Bool("self-sign", false, "If set along with --csr-subject, emit a self-signed certificate instead of a CSR")
+	importPath := flag.String("import", "", "Path to a PEM RSA/ECDSA private key to import instead of generating a new key. If --wrap-with is also set, this path is instead treated as an already-wrapped key blob to unwrap")
+	wrapWith := flag.String("wrap-with", "", "Label of an existing HSM wrapping key to unwrap the --import blob with, instead of calling CreateObject directly")
+	wrapMechanism := flag.String("wrap-mechanism", "RSA-OAEP", "Mechanism to use with --wrap-with (RSA-OAEP or AES-KWP)")
+	manifestPath := flag.String("manifest", "", "If set, write a JSON manifest describing the generated key to this path")
 	flag.Parse()
 
 	if *module == "" {
-		panic("--module is required")
+		return errors.New("--module is required")
 	}
-	if *keyType == "" {
-		panic("--type is required")
+	if *importPath == "" || *wrapWith != "" {
+		if *keyType == "" {
+			return errors.New("--type is required")
+		}
+		if *importPath == "" && *keyType != "RSA" && *keyType != "ECDSA" && *keyType != "Ed25519" {
+			return errors.New("--type may only be RSA, ECDSA, or Ed25519")
+		}
+		if *wrapWith != "" && *keyType != "RSA" && *keyType != "ECDSA" {
+			return errors.New("--type may only be RSA or ECDSA when used with --wrap-with")
+		}
 	}
-	if *keyType != "RSA" && *keyType != "ECDSA" {
-		panic("--type may only be RSA or ECDSA")
+	if *wrapWith != "" && *importPath == "" {
+		return errors.New("--wrap-with requires --import")
 	}
 	if *pin == "" {
-		panic("--pin is required")
+		return errors.New("--pin is required")
 	}
 	if *label == "" {
-		panic("--label is required")
+		return errors.New("--label is required")
 	}
 
 	ctx := pkcs11.New(*module)
 	if ctx == nil {
-		panic("failed to load module")
+		return errors.New("failed to load module")
 	}
 	err := ctx.Initialize()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	targetSlot := *slot
+	if *tokenLabel != "" {
+		targetSlot, err = findSlotByTokenLabel(ctx, *tokenLabel)
+		if err != nil {
+			return err
+		}
 	}
 
-	session, err := ctx.OpenSession(*slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	session, err := ctx.OpenSession(targetSlot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = ctx.Login(session, pkcs11.CKU_USER, *pin)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if *importPath != "" {
+		if *wrapWith != "" {
+			var mechanism uint
+			switch *wrapMechanism {
+			case "RSA-OAEP":
+				mechanism = pkcs11.CKM_RSA_PKCS_OAEP
+			case "AES-KWP":
+				mechanism = pkcs11.CKM_AES_KEY_WRAP_PAD
+			default:
+				return fmt.Errorf("unsupported --wrap-mechanism %q", *wrapMechanism)
+			}
+			var unwrapKeyType uint
+			switch *keyType {
+			case "RSA":
+				unwrapKeyType = pkcs11.CKK_RSA
+			case "ECDSA":
+				unwrapKeyType = pkcs11.CKK_EC
+			}
+			_, err = UnwrapKey(ctx, session, *label, *importPath, *wrapWith, mechanism, unwrapKeyType)
+			if err != nil {
+				return err
+			}
+			if *manifestPath != "" {
+				// The plaintext key never existed in this process, so there's
+				// no SKI or public key PEM to record.
+				m, err := buildImportManifest(ctx, *module, targetSlot, *label, *keyType, nil, nil)
+				if err != nil {
+					return err
+				}
+				return writeManifestFile(*manifestPath, m)
+			}
+			return nil
+		}
+		pubKey, pubHandle, privHandle, err := ImportKey(ctx, session, *label, *importPath)
+		if err != nil {
+			return err
+		}
+		if *manifestPath != "" {
+			ski, err := stampKeyID(ctx, session, pubHandle, privHandle, pubKey)
+			if err != nil {
+				return err
+			}
+			m, err := buildImportManifest(ctx, *module, targetSlot, *label, "", ski, pubKey)
+			if err != nil {
+				return err
+			}
+			return writeManifestFile(*manifestPath, m)
+		}
+		return nil
 	}
 
 	var pubKey interface{}
+	var pubHandle, privHandle pkcs11.ObjectHandle
 	switch *keyType {
 	case "RSA":
 		if *rsaModLen == 0 {
-			panic("--modulus-bits is required")
+			return errors.New("--modulus-bits is required")
 		}
-		m, pubTmpl, privTmpl := rsaArgs(*label, *rsaModLen)
-		pub, _, err := ctx.GenerateKeyPair(session, m, pubTmpl, privTmpl)
+		pubKey, pubHandle, privHandle, err = GenerateRSAKey(ctx, session, *label, *rsaModLen)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		pubKey = rsaPub(ctx, session, pub)
 	case "ECDSA":
 		if *ecdsaCurve == "" {
-			panic("--ecdsaCurve is required")
+			return errors.New("--curve is required")
 		}
 		curve, present := stringToCurve[*ecdsaCurve]
 		if !present {
-			panic("curve not supported")
+			return errors.New("curve not supported")
+		}
+		pubKey, pubHandle, privHandle, err = GenerateECKey(ctx, session, *label, curve)
+		if err != nil {
+			return err
 		}
-		m, pubTmpl, privTmpl := ecArgs(*label, curve)
-		pub, _, err := ctx.GenerateKeyPair(session, m, pubTmpl, privTmpl)
+	case "Ed25519":
+		pubKey, pubHandle, privHandle, err = GenerateEdKey(ctx, session, *label)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		pubKey = ecPub(ctx, session, pub, curve)
 	}
 
-	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	ski, err := stampKeyID(ctx, session, pubHandle, privHandle, pubKey)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if *manifestPath != "" {
+		m, err := buildManifest(ctx, *module, targetSlot, *label, ski, pubKey)
+		if err != nil {
+			return err
+		}
+		if err := writeManifestFile(*manifestPath, m); err != nil {
+			return err
+		}
 	}
 
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
 	err = pem.Encode(os.Stdout, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if *csrSubject == "" {
+		return nil
+	}
+	signer := &pkcs11Signer{ctx: ctx, session: session, object: privHandle, pub: pubKey}
+	subject, err := parseSubject(*csrSubject)
+	if err != nil {
+		return err
+	}
+	if *selfSign {
+		return emitSelfSignedCert(signer, subject)
+	}
+	return emitCSR(signer, subject)
+}
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Manifest describes a key generated by this tool, so that Boulder's
+// ceremony and pkcs11key packages can load it by label/ID without an
+// operator hand-copying values out of this tool's PEM output.
+type Manifest struct {
+	Module       string `json:"module"`
+	Slot         uint   `json:"slot"`
+	TokenLabel   string `json:"tokenLabel"`
+	TokenSerial  string `json:"tokenSerial"`
+	Label        string `json:"label"`
+	ID           string `json:"id"`
+	KeyType      string `json:"keyType"`
+	ModulusBits  int    `json:"modulusBits,omitempty"`
+	Curve        string `json:"curve,omitempty"`
+	PublicKeyPEM string `json:"publicKeyPEM"`
+}
+
+// subjectKeyID computes the SHA-1 of the raw subjectPublicKey bit string
+// within pubKey's SubjectPublicKeyInfo, the same "method 1" derivation
+// RFC 5280 describes for X.509 Subject Key Identifiers.
+func subjectKeyID(pubKey interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	ski := sha1.Sum(spki.PublicKey.Bytes)
+	return ski[:], nil
+}
+
+// setKeyID sets CKA_ID to id on both the public and private key objects, so
+// that later FindObjects calls can look the pair up by SKI the way Fabric's
+// getECKey does.
+func setKeyID(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, pub, priv pkcs11.ObjectHandle, id []byte) error {
+	attrs := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)}
+	if err := ctx.SetAttributeValue(session, pub, attrs); err != nil {
+		return fmt.Errorf("failed to set CKA_ID on public key: %s", err)
+	}
+	if err := ctx.SetAttributeValue(session, priv, attrs); err != nil {
+		return fmt.Errorf("failed to set CKA_ID on private key: %s", err)
+	}
+	return nil
+}
+
+// stampKeyID computes the SKI for pubKey and stamps it as CKA_ID onto pub
+// and priv, returning the SKI so callers can also record it in a manifest.
+// This runs at generation time regardless of whether a manifest is written,
+// so that FindObjects-by-SKI always works against a freshly generated pair.
+func stampKeyID(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, pub, priv pkcs11.ObjectHandle, pubKey interface{}) ([]byte, error) {
+	ski, err := subjectKeyID(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute key ID: %s", err)
+	}
+	if err := setKeyID(ctx, session, pub, priv, ski); err != nil {
+		return nil, err
+	}
+	return ski, nil
+}
+
+// buildManifest assembles a Manifest describing a generated key pair, given
+// the SKI already stamped onto it by stampKeyID.
+func buildManifest(ctx *pkcs11.Ctx, module string, slot uint, label string, ski []byte, pubKey interface{}) (*Manifest, error) {
+	tokenInfo, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token info: %s", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	m := &Manifest{
+		Module:       module,
+		Slot:         slot,
+		TokenLabel:   tokenInfo.Label,
+		TokenSerial:  tokenInfo.SerialNumber,
+		Label:        label,
+		ID:           fmt.Sprintf("%x", ski),
+		PublicKeyPEM: string(pemBytes),
+	}
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		m.KeyType = "RSA"
+		m.ModulusBits = k.N.BitLen()
+	case *ecdsa.PublicKey:
+		m.KeyType = "ECDSA"
+		m.Curve = k.Curve.Params().Name
+	case ed25519.PublicKey:
+		m.KeyType = "Ed25519"
+	}
+	return m, nil
+}
+
+// buildImportManifest assembles a Manifest for a key that was imported or
+// unwrapped rather than generated. ski is nil when the plaintext key never
+// existed in this process (the --wrap-with path), in which case the ID and
+// public key PEM fields are left blank.
+func buildImportManifest(ctx *pkcs11.Ctx, module string, slot uint, label, keyType string, ski []byte, pubKey interface{}) (*Manifest, error) {
+	tokenInfo, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token info: %s", err)
+	}
+
+	m := &Manifest{
+		Module:      module,
+		Slot:        slot,
+		TokenLabel:  tokenInfo.Label,
+		TokenSerial: tokenInfo.SerialNumber,
+		Label:       label,
+		KeyType:     keyType,
+	}
+	if ski != nil {
+		m.ID = fmt.Sprintf("%x", ski)
+	}
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		m.KeyType = "RSA"
+		m.ModulusBits = k.N.BitLen()
+	case *ecdsa.PublicKey:
+		m.KeyType = "ECDSA"
+		m.Curve = k.Curve.Params().Name
+	case ed25519.PublicKey:
+		m.KeyType = "Ed25519"
+	}
+	if pubKey != nil {
+		der, err := x509.MarshalPKIXPublicKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		m.PublicKeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	return m, nil
+}
+
+// writeManifestFile writes m to path as indented JSON.
+func writeManifestFile(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// hashPrefixes contains the DER encoded PKCS#1 DigestInfo prefixes that
+// CKM_RSA_PKCS expects to be prepended to the raw digest before signing,
+// keyed by the crypto.Hash that produced the digest.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// ecdsaSignature is the ASN.1 structure that ECDSA signatures are encoded in
+// outside of PKCS#11, i.e. what x509.CreateCertificate and friends expect
+// crypto.Signer.Sign to return.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// pkcs11Signer implements crypto.Signer using a key pair that was generated
+// on, and never leaves, an HSM. It is handed directly to x509.CreateCertificate
+// and x509.CreateCertificateRequest so that CSRs and certificates can be
+// produced without the private key ever touching this process' memory.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	object  pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+}
+
+func (p *pkcs11Signer) Public() crypto.PublicKey {
+	return p.pub
+}
+
+func (p *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch p.pub.(type) {
+	case *rsa.PublicKey:
+		return p.signRSA(digest, opts)
+	case *ecdsa.PublicKey:
+		return p.signECDSA(digest)
+	case ed25519.PublicKey:
+		return p.signEd25519(digest)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", p.pub)
+	}
+}
+
+func (p *pkcs11Signer) signRSA(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	prefix, present := hashPrefixes[opts.HashFunc()]
+	if !present {
+		return nil, fmt.Errorf("unsupported hash function %s", opts.HashFunc())
+	}
+	err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}, p.object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize RSA signing: %s", err)
+	}
+	sig, err := p.ctx.Sign(p.session, append(prefix, digest...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %s", err)
+	}
+	return sig, nil
+}
+
+// ckmEDDSA is CKM_EDDSA, a PKCS#11 3.0 mechanism that github.com/miekg/pkcs11
+// has not picked up yet. See the matching comment on ckmECEdwardsKeyPairGen
+// in ed25519.go.
+const ckmEDDSA = 0x00001057
+
+func (p *pkcs11Signer) signEd25519(message []byte) ([]byte, error) {
+	err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEDDSA, nil)}, p.object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Ed25519 signing: %s", err)
+	}
+	sig, err := p.ctx.Sign(p.session, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %s", err)
+	}
+	return sig, nil
+}
+
+func (p *pkcs11Signer) signECDSA(digest []byte) ([]byte, error) {
+	err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, p.object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize ECDSA signing: %s", err)
+	}
+	sig, err := p.ctx.Sign(p.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %s", err)
+	}
+	if len(sig)%2 != 0 {
+		return nil, errors.New("malformed ECDSA signature returned by PKCS#11 module")
+	}
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}